@@ -9,12 +9,19 @@
 package hyrumtoken
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
@@ -66,3 +73,493 @@ func Unmarshal(key *[32]byte, s string, v any) error {
 
 	return nil
 }
+
+// ErrTokenExpired is returned by UnmarshalWithOptions when s is presented
+// after the TTL given to MarshalWithOptions has elapsed.
+var ErrTokenExpired = errors.New("hyrumtoken: token expired")
+
+// MarshalOptions configures the optional behaviors of MarshalWithOptions and
+// UnmarshalWithOptions.
+type MarshalOptions struct {
+	// TTL, if nonzero, causes tokens to stop being accepted by
+	// UnmarshalWithOptions once TTL has elapsed since they were minted.
+	TTL time.Duration
+
+	// Clock returns the current time. It defaults to time.Now, and exists
+	// as an injection point for tests.
+	Clock func() time.Time
+}
+
+func (o MarshalOptions) clock() func() time.Time {
+	if o.Clock != nil {
+		return o.Clock
+	}
+	return time.Now
+}
+
+// MarshalWithOptions returns an encrypted, URL-safe serialization of v using
+// key, honoring the behaviors configured by opts.
+//
+// MarshalWithOptions panics if v cannot be JSON-encoded.
+//
+// MarshalWithOptions uses a random nonce. Providing the same key and v in
+// multiple invocations will produce different results every time.
+func MarshalWithOptions(key *[32]byte, opts MarshalOptions, v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	var notAfter int64
+	if opts.TTL > 0 {
+		notAfter = opts.clock()().Add(opts.TTL).UnixNano()
+	}
+
+	payload := make([]byte, 8+len(b))
+	binary.BigEndian.PutUint64(payload[:8], uint64(notAfter))
+	copy(payload[8:], b)
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+
+	d := secretbox.Seal(nonce[:], payload, &nonce, key)
+	return base64.URLEncoding.EncodeToString(d)
+}
+
+// UnmarshalWithOptions uses key to decrypt s and store the decoded value in
+// v, honoring the behaviors configured by opts.
+//
+// If s is empty, v is not modified and UnmarshalWithOptions returns nil.
+//
+// UnmarshalWithOptions returns ErrTokenExpired if s was minted with a TTL
+// that has since elapsed, as measured by opts.Clock.
+func UnmarshalWithOptions(key *[32]byte, opts MarshalOptions, s string, v any) error {
+	if s == "" {
+		return nil
+	}
+
+	d, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("decode token: %w", err)
+	}
+
+	if len(d) < 24 {
+		return fmt.Errorf("decode token: token too short")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], d[:24])
+
+	payload, ok := secretbox.Open(nil, d[24:], &nonce, key)
+	if !ok {
+		return fmt.Errorf("decrypt token: secretbox open failed")
+	}
+
+	if len(payload) < 8 {
+		return fmt.Errorf("decode token: payload too short")
+	}
+
+	notAfter := int64(binary.BigEndian.Uint64(payload[:8]))
+	if notAfter != 0 && !opts.clock()().Before(time.Unix(0, notAfter)) {
+		return ErrTokenExpired
+	}
+
+	if err := json.Unmarshal(payload[8:], v); err != nil {
+		return fmt.Errorf("unmarshal token data: %w", err)
+	}
+
+	return nil
+}
+
+// SealFor returns an encrypted, URL-safe serialization of v, addressed to
+// the holder of recipientPub and signed with senderPriv, using
+// golang.org/x/crypto/nacl/box.
+//
+// Unlike Marshal, SealFor does not require the sender and recipient to
+// share a symmetric key. This makes it suitable for a service A to mint a
+// pagination or continuation token that is only consumable by a service B:
+// A calls SealFor with B's public key and A's own private key, and B calls
+// OpenFrom with B's private key and A's public key.
+//
+// SealFor panics if v cannot be JSON-encoded.
+func SealFor(recipientPub *[32]byte, senderPriv *[32]byte, v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+
+	d := box.Seal(nonce[:], b, &nonce, recipientPub, senderPriv)
+	return base64.URLEncoding.EncodeToString(d)
+}
+
+// OpenFrom uses recipientPriv to decrypt s and verify it was sent by the
+// holder of senderPriv, storing the decoded value in v. See SealFor.
+//
+// If s is empty, v is not modified and OpenFrom returns nil.
+func OpenFrom(recipientPriv *[32]byte, senderPub *[32]byte, s string, v any) error {
+	if s == "" {
+		return nil
+	}
+
+	d, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("decode token: %w", err)
+	}
+
+	if len(d) < 24 {
+		return fmt.Errorf("decode token: token too short")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], d[:24])
+
+	b, ok := box.Open(nil, d[24:], &nonce, senderPub, recipientPriv)
+	if !ok {
+		return fmt.Errorf("decrypt token: box open failed")
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("unmarshal token data: %w", err)
+	}
+
+	return nil
+}
+
+// ErrCodecMismatch is returned by UnmarshalWith when s was encoded with a
+// different Codec than the one passed to UnmarshalWith.
+var ErrCodecMismatch = errors.New("hyrumtoken: codec mismatch")
+
+// A Codec encodes and decodes the values stored inside a token. MarshalWith
+// and UnmarshalWith accept any Codec, which is useful for cursor types that
+// don't serialize well as JSON, or where token size matters.
+//
+// MarshalWith and UnmarshalWith use a wire format distinct from Marshal and
+// Unmarshal, even when passed JSONCodec: MarshalWith prefixes the encoded
+// value with the codec's ID byte, which Marshal does not. Tokens produced
+// by one are not accepted by the other; use Marshal/Unmarshal and
+// MarshalWith/UnmarshalWith consistently within a given call site.
+type Codec interface {
+	// ID uniquely identifies the codec. It is stored alongside the
+	// encoded value so that UnmarshalWith can detect a codec mismatch
+	// rather than failing decoding in a confusing way.
+	ID() byte
+
+	Marshal(v any) ([]byte, error)
+	Unmarshal(b []byte, v any) error
+}
+
+// JSONCodec encodes values using encoding/json, the same encoding Marshal
+// and Unmarshal use.
+var JSONCodec Codec = jsonCodec{}
+
+// GobCodec encodes values using encoding/gob. It produces smaller tokens than
+// JSONCodec for bare numeric and []byte cursors. For struct cursors it
+// produces larger tokens, because each token carries gob's description of
+// the struct type. It requires the same concrete Go type on encode and
+// decode.
+var GobCodec Codec = gobCodec{}
+
+// There is intentionally no built-in protobuf or msgpack Codec: both
+// require a third-party dependency, and this module otherwise only depends
+// on the crypto packages its token format needs. A proto.Message or
+// msgpack-generated type can still be used with MarshalWith/UnmarshalWith
+// by wrapping its own Marshal/Unmarshal methods in a Codec implementation.
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte { return 1 }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(b []byte, v any) error { return json.Unmarshal(b, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte { return 2 }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// MarshalWith returns an encrypted, URL-safe serialization of v using key,
+// encoding v with codec instead of encoding/json.
+//
+// MarshalWith panics if v cannot be encoded by codec.
+//
+// MarshalWith uses a random nonce. Providing the same key, codec, and v in
+// multiple invocations will produce different results every time.
+func MarshalWith(key *[32]byte, codec Codec, v any) string {
+	b, err := codec.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	payload := make([]byte, 1+len(b))
+	payload[0] = codec.ID()
+	copy(payload[1:], b)
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+
+	d := secretbox.Seal(nonce[:], payload, &nonce, key)
+	return base64.URLEncoding.EncodeToString(d)
+}
+
+// UnmarshalWith uses key to decrypt s and store the value decoded by codec
+// in v.
+//
+// If s is empty, v is not modified and UnmarshalWith returns nil.
+//
+// UnmarshalWith returns ErrCodecMismatch if s was encoded with a codec other
+// than codec.
+func UnmarshalWith(key *[32]byte, codec Codec, s string, v any) error {
+	if s == "" {
+		return nil
+	}
+
+	d, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("decode token: %w", err)
+	}
+
+	if len(d) < 24 {
+		return fmt.Errorf("decode token: token too short")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], d[:24])
+
+	payload, ok := secretbox.Open(nil, d[24:], &nonce, key)
+	if !ok {
+		return fmt.Errorf("decrypt token: secretbox open failed")
+	}
+
+	if len(payload) < 1 {
+		return fmt.Errorf("decode token: payload too short")
+	}
+
+	if payload[0] != codec.ID() {
+		return ErrCodecMismatch
+	}
+
+	if err := codec.Unmarshal(payload[1:], v); err != nil {
+		return fmt.Errorf("unmarshal token data: %w", err)
+	}
+
+	return nil
+}
+
+// keyringVersion is the version byte prefixed to tokens produced by
+// MarshalWithKeyring. It exists so UnmarshalWithKeyring can reject tokens
+// from an incompatible future format.
+const keyringVersion = 1
+
+// keyIDLen is the length in bytes of a KeyID.
+const keyIDLen = 4
+
+// A KeyID identifies a key within a Keyring.
+type KeyID [keyIDLen]byte
+
+// ErrUnknownKeyID is returned by UnmarshalWithKeyring when a token's key id
+// does not match any key in the Keyring.
+var ErrUnknownKeyID = errors.New("hyrumtoken: unknown key id")
+
+// A Keyring holds the key used to encrypt new tokens, plus any number of
+// additional keys that are only used to decrypt existing tokens. Keyring
+// allows operators to rotate the key used by MarshalWithKeyring without
+// invalidating tokens minted under an older key.
+type Keyring struct {
+	// PrimaryKeyID is the KeyID of the key used to encrypt new tokens.
+	PrimaryKeyID KeyID
+
+	// Keys maps KeyID to secretbox key. It must contain PrimaryKeyID, and
+	// should contain an entry for every key that may appear in an
+	// outstanding token.
+	Keys map[KeyID]*[32]byte
+}
+
+// MarshalWithKeyring returns an encrypted, URL-safe serialization of v,
+// encrypted under kr's primary key.
+//
+// MarshalWithKeyring panics if v cannot be JSON-encoded.
+func MarshalWithKeyring(kr *Keyring, v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+
+	key := kr.Keys[kr.PrimaryKeyID]
+	d := secretbox.Seal(nonce[:], b, &nonce, key)
+
+	out := make([]byte, 0, 1+keyIDLen+len(d))
+	out = append(out, keyringVersion)
+	out = append(out, kr.PrimaryKeyID[:]...)
+	out = append(out, d...)
+
+	return base64.URLEncoding.EncodeToString(out)
+}
+
+// UnmarshalWithKeyring uses kr to decrypt s and store the decoded value in
+// v. It looks up the key to use by reading the KeyID embedded in s, so it
+// can decrypt tokens minted under any key present in kr, not just the
+// primary one.
+//
+// If s is empty, v is not modified and UnmarshalWithKeyring returns nil.
+//
+// UnmarshalWithKeyring returns ErrUnknownKeyID if s was encrypted under a
+// KeyID that is not present in kr.
+func UnmarshalWithKeyring(kr *Keyring, s string, v any) error {
+	if s == "" {
+		return nil
+	}
+
+	d, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("decode token: %w", err)
+	}
+
+	if len(d) < 1+keyIDLen+24 {
+		return fmt.Errorf("decode token: token too short")
+	}
+
+	if d[0] != keyringVersion {
+		return fmt.Errorf("decode token: unsupported version %d", d[0])
+	}
+
+	var keyID KeyID
+	copy(keyID[:], d[1:1+keyIDLen])
+
+	key, ok := kr.Keys[keyID]
+	if !ok {
+		return ErrUnknownKeyID
+	}
+
+	d = d[1+keyIDLen:]
+
+	var nonce [24]byte
+	copy(nonce[:], d[:24])
+
+	b, ok := secretbox.Open(nil, d[24:], &nonce, key)
+	if !ok {
+		return fmt.Errorf("decrypt token: secretbox open failed")
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("unmarshal token data: %w", err)
+	}
+
+	return nil
+}
+
+// ErrWrongContext is returned by UnmarshalInContext when s was minted by
+// MarshalDeterministic under a different contextLabel.
+var ErrWrongContext = errors.New("hyrumtoken: wrong context")
+
+// MarshalDeterministic returns an encrypted, URL-safe serialization of v
+// using key, like Marshal, but derives its nonce from key, contextLabel,
+// and the JSON encoding of v instead of reading from crypto/rand.
+//
+// As a result, calling MarshalDeterministic with the same key, contextLabel,
+// and v always produces the same token. This is useful for idempotency keys
+// and for caching or deduplicating pagination cursors. contextLabel also
+// scopes tokens to a particular use: a token minted with contextLabel
+// "listUsers" fails UnmarshalInContext when checked against "listOrgs",
+// even though both use the same key.
+//
+// MarshalDeterministic gives up the semantic-security guarantees of a
+// random nonce: an attacker who can observe tokens can tell whether two
+// tokens encode the same (contextLabel, v). Only use it when v's plaintext
+// space is high-entropy, or when leaking equality of v across tokens is
+// acceptable.
+//
+// MarshalDeterministic panics if v cannot be JSON-encoded.
+func MarshalDeterministic(key *[32]byte, contextLabel string, v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	nonce := deterministicNonce(key, contextLabel, b)
+
+	d := secretbox.Seal(nonce[:], b, &nonce, key)
+	return base64.URLEncoding.EncodeToString(d)
+}
+
+// UnmarshalInContext uses key to decrypt s and store the decoded value in
+// v. See MarshalDeterministic.
+//
+// If s is empty, v is not modified and UnmarshalInContext returns nil.
+//
+// UnmarshalInContext returns ErrWrongContext if s was minted with a
+// contextLabel other than contextLabel.
+func UnmarshalInContext(key *[32]byte, contextLabel string, s string, v any) error {
+	if s == "" {
+		return nil
+	}
+
+	d, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("decode token: %w", err)
+	}
+
+	if len(d) < 24 {
+		return fmt.Errorf("decode token: token too short")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], d[:24])
+
+	b, ok := secretbox.Open(nil, d[24:], &nonce, key)
+	if !ok {
+		return fmt.Errorf("decrypt token: secretbox open failed")
+	}
+
+	if nonce != deterministicNonce(key, contextLabel, b) {
+		return ErrWrongContext
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("unmarshal token data: %w", err)
+	}
+
+	return nil
+}
+
+// deterministicNonce derives a 24-byte secretbox nonce from key,
+// contextLabel, and the canonical (JSON) encoding of a token's plaintext.
+func deterministicNonce(key *[32]byte, contextLabel string, plaintext []byte) [24]byte {
+	h, err := blake2b.New(24, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	h.Write(key[:])
+	h.Write([]byte(contextLabel))
+	h.Write(plaintext)
+
+	var nonce [24]byte
+	copy(nonce[:], h.Sum(nil))
+	return nonce
+}
@@ -2,10 +2,13 @@ package hyrumtoken_test
 
 import (
 	"crypto/rand"
+	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/ssoready/hyrumtoken"
+	"golang.org/x/crypto/nacl/box"
 )
 
 // testkey is a randomized key for testing. Do not use it in production.
@@ -79,6 +82,235 @@ func TestEncoder_Unmarshal(t *testing.T) {
 	}
 }
 
+func TestMarshalDeterministic(t *testing.T) {
+	type data struct{ Foo string }
+	in := data{Foo: "foo"}
+
+	tokenA := hyrumtoken.MarshalDeterministic(&testkey, "listUsers", in)
+	tokenB := hyrumtoken.MarshalDeterministic(&testkey, "listUsers", in)
+
+	if tokenA != tokenB {
+		t.Fatalf("expected deterministic tokens to match, got %q and %q", tokenA, tokenB)
+	}
+
+	var out data
+	if err := hyrumtoken.UnmarshalInContext(&testkey, "listUsers", tokenA, &out); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round-trip failure")
+	}
+
+	err := hyrumtoken.UnmarshalInContext(&testkey, "listOrgs", tokenA, &out)
+	if !errors.Is(err, hyrumtoken.ErrWrongContext) {
+		t.Fatalf("expected ErrWrongContext, got: %v", err)
+	}
+}
+
+func TestUnmarshalInContext_shortToken(t *testing.T) {
+	var out string
+	err := hyrumtoken.UnmarshalInContext(&testkey, "listUsers", "AAAA", &out)
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestSealFor_OpenFrom(t *testing.T) {
+	recipientPub, recipientPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate recipient key: %v", err)
+	}
+
+	senderPub, senderPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate sender key: %v", err)
+	}
+
+	type data struct{ Foo string }
+	in := data{Foo: "foo"}
+
+	token := hyrumtoken.SealFor(recipientPub, senderPriv, in)
+
+	var out data
+	if err := hyrumtoken.OpenFrom(recipientPriv, senderPub, token, &out); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round-trip failure")
+	}
+}
+
+func TestOpenFrom_shortToken(t *testing.T) {
+	_, recipientPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate recipient key: %v", err)
+	}
+
+	senderPub, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate sender key: %v", err)
+	}
+
+	var out string
+	if err := hyrumtoken.OpenFrom(recipientPriv, senderPub, "AAAA", &out); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestMarshalWith_gob(t *testing.T) {
+	type data struct {
+		Foo string
+		Bar int
+	}
+	in := data{Foo: "foo", Bar: 123}
+
+	token := hyrumtoken.MarshalWith(&testkey, hyrumtoken.GobCodec, in)
+
+	var out data
+	if err := hyrumtoken.UnmarshalWith(&testkey, hyrumtoken.GobCodec, token, &out); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round-trip failure")
+	}
+}
+
+func TestMarshalWith_codecMismatch(t *testing.T) {
+	token := hyrumtoken.MarshalWith(&testkey, hyrumtoken.JSONCodec, "foo")
+
+	var out string
+	err := hyrumtoken.UnmarshalWith(&testkey, hyrumtoken.GobCodec, token, &out)
+	if !errors.Is(err, hyrumtoken.ErrCodecMismatch) {
+		t.Fatalf("expected ErrCodecMismatch, got: %v", err)
+	}
+}
+
+func TestMarshalWith_shortToken(t *testing.T) {
+	var out string
+	err := hyrumtoken.UnmarshalWith(&testkey, hyrumtoken.JSONCodec, "AAAA", &out)
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestMarshalWithOptions_ttl(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := hyrumtoken.MarshalOptions{
+		TTL:   time.Minute,
+		Clock: func() time.Time { return now },
+	}
+
+	token := hyrumtoken.MarshalWithOptions(&testkey, opts, "foo")
+
+	var out string
+	if err := hyrumtoken.UnmarshalWithOptions(&testkey, opts, token, &out); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if out != "foo" {
+		t.Fatalf("round-trip failure: %q", out)
+	}
+
+	opts.Clock = func() time.Time { return now.Add(2 * time.Minute) }
+	if err := hyrumtoken.UnmarshalWithOptions(&testkey, opts, token, &out); !errors.Is(err, hyrumtoken.ErrTokenExpired) {
+		t.Fatalf("expected ErrTokenExpired, got: %v", err)
+	}
+}
+
+func TestMarshalWithOptions_noTTL(t *testing.T) {
+	opts := hyrumtoken.MarshalOptions{}
+	token := hyrumtoken.MarshalWithOptions(&testkey, opts, "foo")
+
+	opts.Clock = func() time.Time { return time.Now().AddDate(10, 0, 0) }
+
+	var out string
+	if err := hyrumtoken.UnmarshalWithOptions(&testkey, opts, token, &out); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if out != "foo" {
+		t.Fatalf("round-trip failure: %q", out)
+	}
+}
+
+func TestMarshalWithOptions_shortToken(t *testing.T) {
+	opts := hyrumtoken.MarshalOptions{}
+
+	var out string
+	err := hyrumtoken.UnmarshalWithOptions(&testkey, opts, "AAAA", &out)
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestKeyring_rotation(t *testing.T) {
+	oldKey := [32]byte{1, 2, 3}
+	newKey := [32]byte{4, 5, 6}
+
+	kr := hyrumtoken.Keyring{
+		PrimaryKeyID: hyrumtoken.KeyID{0, 0, 0, 1},
+		Keys: map[hyrumtoken.KeyID]*[32]byte{
+			{0, 0, 0, 1}: &oldKey,
+		},
+	}
+
+	type data struct{ Foo string }
+	in := data{Foo: "foo"}
+
+	oldToken := hyrumtoken.MarshalWithKeyring(&kr, in)
+
+	// rotate: mint new tokens under newKey, but keep oldKey around for
+	// decrypting outstanding tokens
+	kr = hyrumtoken.Keyring{
+		PrimaryKeyID: hyrumtoken.KeyID{0, 0, 0, 2},
+		Keys: map[hyrumtoken.KeyID]*[32]byte{
+			{0, 0, 0, 1}: &oldKey,
+			{0, 0, 0, 2}: &newKey,
+		},
+	}
+
+	newToken := hyrumtoken.MarshalWithKeyring(&kr, in)
+
+	var out data
+	if err := hyrumtoken.UnmarshalWithKeyring(&kr, oldToken, &out); err != nil {
+		t.Fatalf("unexpected err decoding old token: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round-trip failure on old token")
+	}
+
+	out = data{}
+	if err := hyrumtoken.UnmarshalWithKeyring(&kr, newToken, &out); err != nil {
+		t.Fatalf("unexpected err decoding new token: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round-trip failure on new token")
+	}
+}
+
+func TestKeyring_unknownKeyID(t *testing.T) {
+	key := [32]byte{1, 2, 3}
+	kr := hyrumtoken.Keyring{
+		PrimaryKeyID: hyrumtoken.KeyID{0, 0, 0, 1},
+		Keys: map[hyrumtoken.KeyID]*[32]byte{
+			{0, 0, 0, 1}: &key,
+		},
+	}
+
+	token := hyrumtoken.MarshalWithKeyring(&kr, "foo")
+
+	kr2 := hyrumtoken.Keyring{
+		PrimaryKeyID: hyrumtoken.KeyID{0, 0, 0, 2},
+		Keys: map[hyrumtoken.KeyID]*[32]byte{
+			{0, 0, 0, 2}: &key,
+		},
+	}
+
+	var out string
+	err := hyrumtoken.UnmarshalWithKeyring(&kr2, token, &out)
+	if !errors.Is(err, hyrumtoken.ErrUnknownKeyID) {
+		t.Fatalf("expected ErrUnknownKeyID, got: %v", err)
+	}
+}
+
 type zeroReader struct{}
 
 func (z zeroReader) Read(p []byte) (n int, err error) {